@@ -0,0 +1,252 @@
+// This code is in Public Domain. Take all the code you want, I'll just write more.
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	bare "git.sr.ht/~sircmpwn/go-bare"
+
+	"fofou/internal/tsutil"
+)
+
+// archiveIndexPath is forum/<name>.archive-index.csv, a plain
+// "topicId,relativePath\n" mapping kept alongside the hot journal so we
+// can find an archived topic's file without scanning the archive tree.
+func (store *Store) archiveIndexPath() string {
+	return filepath.Join(store.dataDir, "forum", store.forumName+".archive-index.csv")
+}
+
+func (store *Store) archiveRoot() string {
+	return filepath.Join(store.dataDir, "forum", store.forumName, "archive")
+}
+
+// loadArchiveIndex populates store.archiveIndex / store.archiveOrder from
+// archiveIndexPath. A truncated trailing row is ignored, same as the
+// blob store's index.csv.
+func (store *Store) loadArchiveIndex() error {
+	store.archiveIndex = make(map[int]string)
+	store.archiveCache = make(map[int]*Topic)
+
+	path := store.archiveIndexPath()
+	if !PathExists(path) {
+		return nil
+	}
+	data, err := ReadFileAll(path)
+	if err != nil {
+		return err
+	}
+
+	// every complete row ends in '\n', so the last element is either empty
+	// or a row cut short mid-write; it is skipped either way
+	lines := strings.Split(string(data), "\n")
+	for _, line := range lines[:len(lines)-1] {
+		if line == "" {
+			continue
+		}
+		parts := strings.SplitN(line, ",", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		id, err := strconv.Atoi(parts[0])
+		if err != nil {
+			continue
+		}
+		relPath := parts[1]
+		store.archiveIndex[id] = filepath.Join(store.archiveRoot(), relPath)
+		store.archiveOrder = append(store.archiveOrder, id)
+	}
+	return nil
+}
+
+func (store *Store) appendArchiveIndexRecord(ctx context.Context, topicId int, relPath string) error {
+	f, err := os.OpenFile(store.archiveIndexPath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := fmt.Fprintf(f, "%d,%s\n", topicId, relPath); err != nil {
+		return err
+	}
+	return ctxDo(ctx, f.Sync)
+}
+
+// archiveTopic serializes t (and its posts) to
+// forum/<name>/archive/YYYY/MM/topic-<id>.log, using the same framing
+// format as the hot journal, and records it in the archive index.
+func (store *Store) archiveTopic(ctx context.Context, t *Topic) error {
+	last := t.Posts[len(t.Posts)-1].CreatedOn
+	relDir := filepath.Join(fmt.Sprintf("%04d", last.Year()), fmt.Sprintf("%02d", int(last.Month())))
+	if err := os.MkdirAll(filepath.Join(store.archiveRoot(), relDir), 0755); err != nil {
+		return err
+	}
+	relPath := filepath.Join(relDir, fmt.Sprintf("topic-%d.log", t.Id))
+	path := filepath.Join(store.archiveRoot(), relPath)
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := writeFrame(ctx, f, recTypeTopic, TopicRec{Id: uint64(t.Id), Subject: t.Subject}); err != nil {
+		f.Close()
+		return err
+	}
+	for _, p := range t.Posts {
+		rec := PostRec{
+			TopicId:          uint64(t.Id),
+			PostId:           uint64(p.Id),
+			CreatedOnMicros:  uint64(tsutil.TimeToUnixMicro(p.CreatedOn)),
+			MessageSha1:      p.MessageSha1,
+			IpAddrInternal:   p.IpAddrInternal,
+			UserNameInternal: p.UserNameInternal,
+		}
+		if _, err := writeFrame(ctx, f, recTypePost, rec); err != nil {
+			f.Close()
+			return err
+		}
+		if p.IsDeleted {
+			if _, err := writeFrame(ctx, f, recTypeDel, DelRec{TopicId: uint64(t.Id), PostId: uint64(p.Id)}); err != nil {
+				f.Close()
+				return err
+			}
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	store.archiveIndex[t.Id] = path
+	store.archiveOrder = append(store.archiveOrder, t.Id)
+	return store.appendArchiveIndexRecord(ctx, t.Id, relPath)
+}
+
+// Archive moves every topic whose last post is older than olderThan out
+// of the hot in-memory set into the read-only archive tier, returning
+// how many topics were moved.
+func (store *Store) Archive(ctx context.Context, olderThan time.Duration) (int, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	cutoff := time.Now().Add(-olderThan)
+	archivedIds := make(map[int]bool)
+	remaining := make([]Topic, 0, len(store.topics))
+	nMoved := 0
+	for i := range store.topics {
+		if err := ctx.Err(); err != nil {
+			return nMoved, err
+		}
+		t := &store.topics[i]
+		if len(t.Posts) == 0 || !t.Posts[len(t.Posts)-1].CreatedOn.Before(cutoff) {
+			remaining = append(remaining, *t)
+			continue
+		}
+		if err := store.archiveTopic(ctx, t); err != nil {
+			return nMoved, err
+		}
+		archivedIds[t.Id] = true
+		nMoved++
+	}
+	store.topics = remaining
+
+	if nMoved > 0 {
+		filteredPosts := store.posts[:0]
+		for _, p := range store.posts {
+			if !archivedIds[p.Topic.Id] {
+				filteredPosts = append(filteredPosts, p)
+			}
+		}
+		store.posts = filteredPosts
+	}
+	return nMoved, nil
+}
+
+// loadArchivedTopicFile parses a single forum/<name>/archive/.../topic-<id>.log
+// file back into a Topic.
+func loadArchivedTopicFile(path string) (*Topic, error) {
+	data, err := ReadFileAll(path)
+	if err != nil {
+		return nil, err
+	}
+	var topic Topic
+	found := false
+	readFrames(data, func(typ recType, payload []byte) {
+		switch typ {
+		case recTypeTopic:
+			var rec TopicRec
+			if err := bare.Unmarshal(payload, &rec); err != nil {
+				panic(err)
+			}
+			topic = Topic{Id: int(rec.Id), Subject: rec.Subject, Posts: make([]Post, 0)}
+			found = true
+		case recTypePost:
+			var rec PostRec
+			if err := bare.Unmarshal(payload, &rec); err != nil {
+				panic(err)
+			}
+			p := Post{
+				Id:               int(rec.PostId),
+				CreatedOn:        tsutil.UnixMicroToTime(int64(rec.CreatedOnMicros)),
+				MessageSha1:      rec.MessageSha1,
+				UserNameInternal: rec.UserNameInternal,
+				IpAddrInternal:   rec.IpAddrInternal,
+				Topic:            &topic,
+			}
+			topic.Posts = append(topic.Posts, p)
+		case recTypeDel:
+			var rec DelRec
+			if err := bare.Unmarshal(payload, &rec); err != nil {
+				panic(err)
+			}
+			topic.Posts[int(rec.PostId)-1].IsDeleted = true
+		}
+	})
+	if !found {
+		return nil, fmt.Errorf("no topic record in archive file %s", path)
+	}
+	return &topic, nil
+}
+
+// getArchivedTopicUnlocked is GetArchivedTopic for callers that already
+// hold store's mutex (e.g. GetTopics when includeArchive is set).
+func (store *Store) getArchivedTopicUnlocked(id int) (*Topic, error) {
+	if t, ok := store.archiveCache[id]; ok {
+		return t, nil
+	}
+	path, ok := store.archiveIndex[id]
+	if !ok {
+		return nil, fmt.Errorf("no archived topic with id %d", id)
+	}
+	t, err := loadArchivedTopicFile(path)
+	if err != nil {
+		return nil, err
+	}
+	store.archiveCache[id] = t
+	return t, nil
+}
+
+// GetArchivedTopic lazily reads (and caches) an archived topic by id.
+func (store *Store) GetArchivedTopic(ctx context.Context, id int) (*Topic, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	store.Lock()
+	defer store.Unlock()
+	return store.getArchivedTopicUnlocked(id)
+}
+
+// ArchiveDeprecated is Archive without a context, kept for callers not yet
+// migrated to the ctx-first API.
+func (store *Store) ArchiveDeprecated(olderThan time.Duration) (int, error) {
+	return store.Archive(context.Background(), olderThan)
+}
+
+// GetArchivedTopicDeprecated is GetArchivedTopic without a context, kept
+// for callers not yet migrated to the ctx-first API.
+func (store *Store) GetArchivedTopicDeprecated(id int) (*Topic, error) {
+	return store.GetArchivedTopic(context.Background(), id)
+}
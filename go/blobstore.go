@@ -0,0 +1,298 @@
+// This code is in Public Domain. Take all the code you want, I'll just write more.
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultMaxSegmentSize is the default cap, in bytes, for a single blob
+// segment file before we rotate to a new one.
+const DefaultMaxSegmentSize int64 = 64 * 1024 * 1024
+
+// blobLoc describes where a blob lives: which segment, at what offset,
+// and how many bytes it occupies.
+type blobLoc struct {
+	segmentNo int
+	offset    int64
+	size      int64
+}
+
+// BlobStore is an append-only, segmented replacement for the old
+// one-file-per-message blob layout. Blobs are deduped by sha1 and packed
+// into numbered segment files capped at maxSegmentSize, with a single
+// CSV index mapping sha1 -> (segmentNo, offset, size).
+type BlobStore struct {
+	sync.Mutex
+	dir            string
+	maxSegmentSize int64
+
+	index map[string]blobLoc
+
+	curSegmentNo int
+	curSegment   *os.File
+	curSize      int64
+
+	indexFile *os.File
+}
+
+func blobsDir(dir string) string {
+	return filepath.Join(dir, "blobs")
+}
+
+func segmentPath(dir string, segmentNo int) string {
+	return filepath.Join(blobsDir(dir), fmt.Sprintf("seg-%06d.dat", segmentNo))
+}
+
+func indexPath(dir string) string {
+	return filepath.Join(blobsDir(dir), "index.csv")
+}
+
+// NewBlobStore opens (or creates) the segmented blob store rooted at dir,
+// rebuilding the in-memory index from index.csv and reopening the most
+// recent segment for appending.
+func NewBlobStore(dir string, maxSegmentSize int64) (*BlobStore, error) {
+	if maxSegmentSize <= 0 {
+		maxSegmentSize = DefaultMaxSegmentSize
+	}
+	if err := os.MkdirAll(blobsDir(dir), 0755); err != nil {
+		return nil, err
+	}
+	bs := &BlobStore{
+		dir:            dir,
+		maxSegmentSize: maxSegmentSize,
+		index:          make(map[string]blobLoc),
+	}
+	if err := bs.loadIndex(); err != nil {
+		return nil, err
+	}
+	if err := bs.openCurrentSegment(); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(indexPath(dir), os.O_APPEND|os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return nil, err
+	}
+	bs.indexFile = f
+	return bs, nil
+}
+
+// loadIndex parses index.csv, rebuilding the in-memory sha1 -> location
+// map. A truncated trailing row (e.g. from a crash mid-write) is ignored.
+func (bs *BlobStore) loadIndex() error {
+	path := indexPath(bs.dir)
+	if !PathExists(path) {
+		return nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	// every complete row ends in '\n', so the last element is either empty
+	// or a row cut short mid-write; it is skipped either way
+	lines := strings.Split(string(data), "\n")
+	for _, line := range lines[:len(lines)-1] {
+		if line == "" {
+			continue
+		}
+		loc, sha1Hex, ok := parseIndexLine(line)
+		if !ok {
+			// malformed row; ignore it
+			continue
+		}
+		bs.index[sha1Hex] = loc
+		if loc.segmentNo > bs.curSegmentNo {
+			bs.curSegmentNo = loc.segmentNo
+		}
+	}
+	return nil
+}
+
+func parseIndexLine(line string) (blobLoc, string, bool) {
+	parts := strings.Split(line, ",")
+	if len(parts) != 4 {
+		return blobLoc{}, "", false
+	}
+	sha1Hex := parts[0]
+	if len(sha1Hex) != 40 {
+		return blobLoc{}, "", false
+	}
+	segmentNo, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return blobLoc{}, "", false
+	}
+	offset, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return blobLoc{}, "", false
+	}
+	size, err := strconv.ParseInt(parts[3], 10, 64)
+	if err != nil {
+		return blobLoc{}, "", false
+	}
+	return blobLoc{segmentNo: segmentNo, offset: offset, size: size}, sha1Hex, true
+}
+
+func (bs *BlobStore) openCurrentSegment() error {
+	path := segmentPath(bs.dir, bs.curSegmentNo)
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	bs.curSegment = f
+	bs.curSize = fi.Size()
+	return nil
+}
+
+func (bs *BlobStore) rotate() error {
+	if err := bs.curSegment.Close(); err != nil {
+		return err
+	}
+	bs.curSegmentNo++
+	bs.curSize = 0
+	return bs.openCurrentSegment()
+}
+
+// Put writes data to the store, deduping by sha1: if the content already
+// exists, its existing location is reused and no bytes are written. The
+// fsyncs are run via ctxDo so a caller past its deadline doesn't have to
+// wait out a slow disk.
+func (bs *BlobStore) Put(ctx context.Context, data []byte) ([20]byte, error) {
+	var sha1 [20]byte
+	copy(sha1[:], Sha1OfBytes(data))
+	sha1Hex := hex.EncodeToString(sha1[:])
+
+	if err := ctx.Err(); err != nil {
+		return sha1, err
+	}
+
+	bs.Lock()
+	defer bs.Unlock()
+
+	if _, ok := bs.index[sha1Hex]; ok {
+		return sha1, nil
+	}
+
+	if bs.curSize > 0 && bs.curSize+int64(len(data)) > bs.maxSegmentSize {
+		if err := bs.rotate(); err != nil {
+			return sha1, err
+		}
+	}
+
+	offset := bs.curSize
+	n, err := bs.curSegment.Write(data)
+	if err != nil {
+		return sha1, err
+	}
+	if err := ctxDo(ctx, bs.curSegment.Sync); err != nil {
+		return sha1, err
+	}
+	bs.curSize += int64(n)
+
+	loc := blobLoc{segmentNo: bs.curSegmentNo, offset: offset, size: int64(n)}
+	row := fmt.Sprintf("%s,%d,%d,%d\n", sha1Hex, loc.segmentNo, loc.offset, loc.size)
+	if _, err := bs.indexFile.WriteString(row); err != nil {
+		return sha1, err
+	}
+	if err := ctxDo(ctx, bs.indexFile.Sync); err != nil {
+		return sha1, err
+	}
+	bs.index[sha1Hex] = loc
+	return sha1, nil
+}
+
+// Get reads back the blob previously stored under sha1.
+func (bs *BlobStore) Get(ctx context.Context, sha1 [20]byte) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	sha1Hex := hex.EncodeToString(sha1[:])
+
+	bs.Lock()
+	loc, ok := bs.index[sha1Hex]
+	bs.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("no blob with sha1 %s", sha1Hex)
+	}
+
+	f, err := os.Open(segmentPath(bs.dir, loc.segmentNo))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	buf := make([]byte, loc.size)
+	if _, err := f.ReadAt(buf, loc.offset); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// MigrateLegacyBlobs scans the old blobs/xx/yy/<sha1> tree once and
+// ingests every file found into the segmented store, so it can be
+// retired after a one-time upgrade.
+func MigrateLegacyBlobs(ctx context.Context, dir string, bs *BlobStore) (nMigrated int, err error) {
+	root := blobsDir(dir)
+	d1s, err := ioutil.ReadDir(root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	for _, d1 := range d1s {
+		if err := ctx.Err(); err != nil {
+			return nMigrated, err
+		}
+		if !d1.IsDir() || len(d1.Name()) != 2 {
+			continue
+		}
+		d2Path := filepath.Join(root, d1.Name())
+		d2s, err := ioutil.ReadDir(d2Path)
+		if err != nil {
+			return nMigrated, err
+		}
+		for _, d2 := range d2s {
+			if err := ctx.Err(); err != nil {
+				return nMigrated, err
+			}
+			if !d2.IsDir() || len(d2.Name()) != 2 {
+				continue
+			}
+			filesPath := filepath.Join(d2Path, d2.Name())
+			files, err := ioutil.ReadDir(filesPath)
+			if err != nil {
+				return nMigrated, err
+			}
+			for _, fi := range files {
+				if err := ctx.Err(); err != nil {
+					return nMigrated, err
+				}
+				if fi.IsDir() {
+					continue
+				}
+				data, err := ioutil.ReadFile(filepath.Join(filesPath, fi.Name()))
+				if err != nil {
+					return nMigrated, err
+				}
+				if _, err := bs.Put(ctx, data); err != nil {
+					return nMigrated, err
+				}
+				nMigrated++
+			}
+		}
+	}
+	return nMigrated, nil
+}
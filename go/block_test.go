@@ -0,0 +1,76 @@
+// This code is in Public Domain. Take all the code you want, I'll just write more.
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestBlockExactV4(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+	if blocked, _ := store.IsBlocked(ctx, "1.2.3.4"); blocked {
+		t.Fatalf("1.2.3.4 should not be blocked yet")
+	}
+	if err := store.BlockIp(ctx, "1.2.3.4"); err != nil {
+		t.Fatalf("BlockIp() failed with %s", err)
+	}
+	if blocked, _ := store.IsBlocked(ctx, "1.2.3.4"); !blocked {
+		t.Fatalf("1.2.3.4 should be blocked")
+	}
+	if blocked, _ := store.IsBlocked(ctx, "1.2.3.5"); blocked {
+		t.Fatalf("1.2.3.5 should not be blocked")
+	}
+	if err := store.UnblockIp(ctx, "1.2.3.4"); err != nil {
+		t.Fatalf("UnblockIp() failed with %s", err)
+	}
+	if blocked, _ := store.IsBlocked(ctx, "1.2.3.4"); blocked {
+		t.Fatalf("1.2.3.4 should no longer be blocked")
+	}
+}
+
+func TestBlockExactV6(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+	if err := store.BlockIp(ctx, "2001:db8::1"); err != nil {
+		t.Fatalf("BlockIp() failed with %s", err)
+	}
+	if blocked, _ := store.IsBlocked(ctx, "2001:db8::1"); !blocked {
+		t.Fatalf("2001:db8::1 should be blocked")
+	}
+	if blocked, _ := store.IsBlocked(ctx, "2001:db8::2"); blocked {
+		t.Fatalf("2001:db8::2 should not be blocked")
+	}
+}
+
+func TestBlockCIDR(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+	if err := store.BlockIp(ctx, "10.0.0.0/24"); err != nil {
+		t.Fatalf("BlockIp() failed with %s", err)
+	}
+	if blocked, _ := store.IsBlocked(ctx, "10.0.0.42"); !blocked {
+		t.Fatalf("10.0.0.42 should be blocked by the CIDR range")
+	}
+	if blocked, _ := store.IsBlocked(ctx, "10.0.1.42"); blocked {
+		t.Fatalf("10.0.1.42 is outside the CIDR range and should not be blocked")
+	}
+	if err := store.UnblockIp(ctx, "10.0.0.0/24"); err != nil {
+		t.Fatalf("UnblockIp() failed with %s", err)
+	}
+	if blocked, _ := store.IsBlocked(ctx, "10.0.0.42"); blocked {
+		t.Fatalf("10.0.0.42 should no longer be blocked")
+	}
+}
+
+func TestCreateNewPostRejectsBlockedIp(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+	if err := store.BlockIp(ctx, "1.2.3.4"); err != nil {
+		t.Fatalf("BlockIp() failed with %s", err)
+	}
+	_, err := store.CreateNewPost(ctx, "subject", "hello", "user1", "1.2.3.4")
+	if err != ErrBlocked {
+		t.Fatalf("expected ErrBlocked, got %v", err)
+	}
+}
@@ -0,0 +1,24 @@
+// This code is in Public Domain. Take all the code you want, I'll just write more.
+package main
+
+import "context"
+
+// ctxDo runs fn on its own goroutine and returns as soon as either fn
+// completes or ctx is done, whichever comes first. If ctx wins, fn's
+// goroutine is left to finish on its own and its result is discarded —
+// there's no way to abort an in-flight fsync, but callers (e.g. a
+// blocked HTTP handler) shouldn't have to wait past their own deadline
+// for it.
+func ctxDo(ctx context.Context, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() { done <- fn() }()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case err := <-done:
+		return err
+	}
+}
@@ -0,0 +1,18 @@
+// This code is in Public Domain. Take all the code you want, I'll just write more.
+
+// Package tsutil converts between time.Time and the unix-microseconds
+// representation used on disk for post timestamps.
+package tsutil
+
+import "time"
+
+// TimeToUnixMicro converts t to a count of microseconds since the unix
+// epoch, the precision PostRec.CreatedOnMicros is stored at.
+func TimeToUnixMicro(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Microsecond)
+}
+
+// UnixMicroToTime is the inverse of TimeToUnixMicro.
+func UnixMicroToTime(micros int64) time.Time {
+	return time.Unix(0, micros*int64(time.Microsecond))
+}
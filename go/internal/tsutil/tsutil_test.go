@@ -0,0 +1,16 @@
+// This code is in Public Domain. Take all the code you want, I'll just write more.
+package tsutil
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRoundTrip(t *testing.T) {
+	now := time.Date(2026, 7, 29, 12, 30, 0, 123456000, time.UTC)
+	micros := TimeToUnixMicro(now)
+	got := UnixMicroToTime(micros).UTC()
+	if !got.Equal(now) {
+		t.Fatalf("round trip mismatch: started with %v, got %v back", now, got)
+	}
+}
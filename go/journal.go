@@ -0,0 +1,422 @@
+// This code is in Public Domain. Take all the code you want, I'll just write more.
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	bare "git.sr.ht/~sircmpwn/go-bare"
+
+	"fofou/internal/tsutil"
+)
+
+// recType tags each framed record in the journal/snapshot files so a
+// reader knows which struct to bare.Unmarshal the payload into.
+type recType uint8
+
+const (
+	recTypeSnapshotHeader recType = 1
+	recTypeTopic          recType = 2
+	recTypePost           recType = 3
+	recTypeDel            recType = 4
+	recTypeUndel          recType = 5
+	recTypeBlock          recType = 6
+)
+
+// snapshotThreshold is how large (in bytes) we let a journal grow before
+// we fold it into a fresh snapshot and start a new, empty journal.
+const snapshotThreshold int64 = 16 * 1024 * 1024
+
+type snapshotHeaderRec struct {
+	SnapshotId uint64
+}
+
+// TopicRec is the on-disk record for a new topic.
+type TopicRec struct {
+	Id      uint64
+	Subject string
+}
+
+// PostRec is the on-disk record for a new post.
+type PostRec struct {
+	TopicId          uint64
+	PostId           uint64
+	CreatedOnMicros  uint64
+	MessageSha1      [20]byte
+	IpAddrInternal   string
+	UserNameInternal string
+}
+
+// DelRec / UndelRec mark a post deleted / undeleted.
+type DelRec struct {
+	TopicId uint64
+	PostId  uint64
+}
+
+type UndelRec struct {
+	TopicId uint64
+	PostId  uint64
+}
+
+// BlockRec records a block/unblock of an exact IP or CIDR range.
+type BlockRec struct {
+	IpOrCIDR string
+	Blocked  bool
+}
+
+// journal is the versioned, binary append log that replaced the old
+// pipe-delimited forum/<name>.txt format. Every mutation is framed with
+// a 4-byte big-endian length prefix so a torn tail record (e.g. from a
+// crash mid-write) can be detected and truncated on load instead of
+// corrupting the whole file. Once the live journal file grows past
+// snapshotThreshold, its state is folded into forum/<name>.snapshot.bare
+// and a fresh, empty journal is started.
+type journal struct {
+	dataDir     string
+	forumName   string
+	snapshotId  int
+	journalFile *os.File
+	journalSize int64
+}
+
+func (j *journal) snapshotPath() string {
+	return filepath.Join(j.dataDir, "forum", j.forumName+".snapshot.bare")
+}
+
+func (j *journal) journalPath(snapshotId int) string {
+	return filepath.Join(j.dataDir, "forum", fmt.Sprintf("%s.%d.log", j.forumName, snapshotId))
+}
+
+func (j *journal) legacyTextPath() string {
+	return filepath.Join(j.dataDir, "forum", j.forumName+".txt")
+}
+
+// writeFrame appends a single length-prefixed, bare-encoded record. The
+// fsync is run via ctxDo so it can be abandoned once ctx's deadline
+// passes instead of blocking the caller behind a slow disk.
+func writeFrame(ctx context.Context, f *os.File, typ recType, v interface{}) (int64, error) {
+	payload, err := bare.Marshal(v)
+	if err != nil {
+		return 0, err
+	}
+	buf := make([]byte, 1+len(payload))
+	buf[0] = byte(typ)
+	copy(buf[1:], payload)
+
+	var lenBuf [4]byte
+	binary.BigEndian.PutUint32(lenBuf[:], uint32(len(buf)))
+	if _, err := f.Write(lenBuf[:]); err != nil {
+		return 0, err
+	}
+	if _, err := f.Write(buf); err != nil {
+		return 0, err
+	}
+	if err := ctxDo(ctx, f.Sync); err != nil {
+		return 0, err
+	}
+	return int64(len(lenBuf) + len(buf)), nil
+}
+
+// readFrames walks a buffer of concatenated frames, invoking fn for
+// each one. A length prefix promising more bytes than remain in d means
+// the last record was only partially written (a torn tail); that's
+// tolerated by simply stopping.
+func readFrames(d []byte, fn func(typ recType, payload []byte)) {
+	for len(d) >= 4 {
+		n := binary.BigEndian.Uint32(d[:4])
+		if uint64(len(d)-4) < uint64(n) {
+			break
+		}
+		frameBytes := d[4 : 4+n]
+		d = d[4+n:]
+		if len(frameBytes) < 1 {
+			break
+		}
+		fn(recType(frameBytes[0]), frameBytes[1:])
+	}
+}
+
+// openJournal locates the newest snapshot (if any), replays it plus the
+// journal that follows it into topics/recentPosts/blocked, and leaves
+// the journal open for appending new records. If neither a snapshot nor
+// a journal exists yet but a legacy pipe-format file does, it is
+// imported once into an initial snapshot.
+func openJournal(ctx context.Context, dataDir, forumName string, topics *[]Topic, recentPosts *[]*Post, blocked *blockState) (*journal, error) {
+	j := &journal{dataDir: dataDir, forumName: forumName}
+
+	if PathExists(j.snapshotPath()) {
+		snapshotId, err := j.loadSnapshot(topics, recentPosts, blocked)
+		if err != nil {
+			return nil, err
+		}
+		j.snapshotId = snapshotId
+	} else if PathExists(j.legacyTextPath()) {
+		if err := j.importLegacyText(topics, recentPosts, blocked); err != nil {
+			return nil, err
+		}
+		if err := j.writeSnapshot(ctx, 0, *topics, blocked); err != nil {
+			return nil, err
+		}
+		j.snapshotId = 0
+	} else {
+		if err := j.writeSnapshot(ctx, 0, *topics, blocked); err != nil {
+			return nil, err
+		}
+		j.snapshotId = 0
+	}
+
+	if err := j.loadAndOpenJournalFile(topics, recentPosts, blocked); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+func (j *journal) loadSnapshot(topics *[]Topic, recentPosts *[]*Post, blocked *blockState) (int, error) {
+	data, err := ReadFileAll(j.snapshotPath())
+	if err != nil {
+		return 0, err
+	}
+	topicIdToTopic := make(map[int]*Topic)
+	snapshotId := 0
+	readFrames(data, func(typ recType, payload []byte) {
+		applyRecord(typ, payload, topics, recentPosts, blocked, topicIdToTopic, &snapshotId)
+	})
+	return snapshotId, nil
+}
+
+func (j *journal) loadAndOpenJournalFile(topics *[]Topic, recentPosts *[]*Post, blocked *blockState) error {
+	path := j.journalPath(j.snapshotId)
+	topicIdToTopic := make(map[int]*Topic)
+	for i := range *topics {
+		topicIdToTopic[(*topics)[i].Id] = &(*topics)[i]
+	}
+
+	validSize := int64(0)
+	if PathExists(path) {
+		data, err := ReadFileAll(path)
+		if err != nil {
+			return err
+		}
+		snapId := j.snapshotId
+		readFrames(data, func(typ recType, payload []byte) {
+			validSize += int64(4 + 1 + len(payload))
+			applyRecord(typ, payload, topics, recentPosts, blocked, topicIdToTopic, &snapId)
+		})
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	// cut off a torn tail record so the next append starts on a frame
+	// boundary
+	if fi.Size() > validSize {
+		if err := f.Truncate(validSize); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	j.journalFile = f
+	j.journalSize = validSize
+	return nil
+}
+
+// applyRecord decodes one framed record and folds it into the
+// in-progress topics/recentPosts/blocked state being rebuilt on load.
+func applyRecord(typ recType, payload []byte, topics *[]Topic, recentPosts *[]*Post, blocked *blockState, topicIdToTopic map[int]*Topic, snapshotId *int) {
+	switch typ {
+	case recTypeSnapshotHeader:
+		var rec snapshotHeaderRec
+		if err := bare.Unmarshal(payload, &rec); err != nil {
+			panic(err)
+		}
+		*snapshotId = int(rec.SnapshotId)
+	case recTypeTopic:
+		var rec TopicRec
+		if err := bare.Unmarshal(payload, &rec); err != nil {
+			panic(err)
+		}
+		t := Topic{Id: int(rec.Id), Subject: rec.Subject, Posts: make([]Post, 0)}
+		*topics = append(*topics, t)
+		topicIdToTopic[t.Id] = &(*topics)[len(*topics)-1]
+	case recTypePost:
+		var rec PostRec
+		if err := bare.Unmarshal(payload, &rec); err != nil {
+			panic(err)
+		}
+		t, ok := topicIdToTopic[int(rec.TopicId)]
+		if !ok {
+			panic("post record for unknown topic")
+		}
+		p := Post{
+			Id:               int(rec.PostId),
+			CreatedOn:        tsutil.UnixMicroToTime(int64(rec.CreatedOnMicros)),
+			MessageSha1:      rec.MessageSha1,
+			UserNameInternal: rec.UserNameInternal,
+			IpAddrInternal:   rec.IpAddrInternal,
+			Topic:            t,
+		}
+		t.Posts = append(t.Posts, p)
+		*recentPosts = append(*recentPosts, &t.Posts[len(t.Posts)-1])
+	case recTypeDel:
+		var rec DelRec
+		if err := bare.Unmarshal(payload, &rec); err != nil {
+			panic(err)
+		}
+		t, ok := topicIdToTopic[int(rec.TopicId)]
+		if !ok {
+			panic("del record for unknown topic")
+		}
+		t.Posts[int(rec.PostId)-1].IsDeleted = true
+	case recTypeUndel:
+		var rec UndelRec
+		if err := bare.Unmarshal(payload, &rec); err != nil {
+			panic(err)
+		}
+		t, ok := topicIdToTopic[int(rec.TopicId)]
+		if !ok {
+			panic("undel record for unknown topic")
+		}
+		t.Posts[int(rec.PostId)-1].IsDeleted = false
+	case recTypeBlock:
+		var rec BlockRec
+		if err := bare.Unmarshal(payload, &rec); err != nil {
+			panic(err)
+		}
+		blocked.apply(rec.IpOrCIDR, rec.Blocked)
+	default:
+		panic("unexpected record type")
+	}
+}
+
+// importLegacyText is the one-time importer for the old pipe-delimited
+// forum/<name>.txt format, run exactly once when no snapshot exists yet.
+func (j *journal) importLegacyText(topics *[]Topic, recentPosts *[]*Post, blocked *blockState) error {
+	data, err := ReadFileAll(j.legacyTextPath())
+	if err != nil {
+		return err
+	}
+	*topics = parseTopics(data, recentPosts, blocked)
+	return nil
+}
+
+// writeSnapshot atomically (write-then-rename) replaces the snapshot
+// file with one containing snapshotId plus the full current state.
+func (j *journal) writeSnapshot(ctx context.Context, snapshotId int, topics []Topic, blocked *blockState) error {
+	tmpPath := j.snapshotPath() + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	if _, err := writeFrame(ctx, f, recTypeSnapshotHeader, snapshotHeaderRec{SnapshotId: uint64(snapshotId)}); err != nil {
+		f.Close()
+		return err
+	}
+	for _, t := range topics {
+		if _, err := writeFrame(ctx, f, recTypeTopic, TopicRec{Id: uint64(t.Id), Subject: t.Subject}); err != nil {
+			f.Close()
+			return err
+		}
+		for _, p := range t.Posts {
+			rec := PostRec{
+				TopicId:          uint64(t.Id),
+				PostId:           uint64(p.Id),
+				CreatedOnMicros:  uint64(tsutil.TimeToUnixMicro(p.CreatedOn)),
+				MessageSha1:      p.MessageSha1,
+				IpAddrInternal:   p.IpAddrInternal,
+				UserNameInternal: p.UserNameInternal,
+			}
+			if _, err := writeFrame(ctx, f, recTypePost, rec); err != nil {
+				f.Close()
+				return err
+			}
+			if p.IsDeleted {
+				if _, err := writeFrame(ctx, f, recTypeDel, DelRec{TopicId: uint64(t.Id), PostId: uint64(p.Id)}); err != nil {
+					f.Close()
+					return err
+				}
+			}
+		}
+	}
+	for k, v := range blocked.exact {
+		if _, err := writeFrame(ctx, f, recTypeBlock, BlockRec{IpOrCIDR: k, Blocked: v}); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	for k, v := range blocked.cidr {
+		if _, err := writeFrame(ctx, f, recTypeBlock, BlockRec{IpOrCIDR: k, Blocked: v}); err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	if err := ctxDo(ctx, f.Sync); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, j.snapshotPath())
+}
+
+// append durably writes rec to the live journal. It does not rotate: a
+// rotation folds the caller's in-memory topics/blocked into the new
+// snapshot, so callers must apply rec's effect to their in-memory state
+// before asking to rotate, or a rotation triggered by this very append
+// would write a snapshot that doesn't yet reflect the record that
+// triggered it. Call maybeRotate once that's done.
+func (j *journal) append(ctx context.Context, typ recType, rec interface{}) error {
+	n, err := writeFrame(ctx, j.journalFile, typ, rec)
+	if err != nil {
+		return err
+	}
+	j.journalSize += n
+	return nil
+}
+
+// maybeRotate folds topics/blocked into a new snapshot and rotates to a
+// fresh, empty journal if the live journal has grown past
+// snapshotThreshold. Callers should only invoke this after any mutation
+// implied by their most recent append has already been applied to
+// topics/blocked, so the snapshot is never missing a durable record.
+func (j *journal) maybeRotate(ctx context.Context, topics []Topic, blocked *blockState) error {
+	if j.journalSize < snapshotThreshold {
+		return nil
+	}
+	return j.rotate(ctx, topics, blocked)
+}
+
+// rotate folds the current state into a new snapshot and starts a fresh
+// journal file numbered after the new snapshot id.
+func (j *journal) rotate(ctx context.Context, topics []Topic, blocked *blockState) error {
+	newSnapshotId := j.snapshotId + 1
+	if err := j.writeSnapshot(ctx, newSnapshotId, topics, blocked); err != nil {
+		return err
+	}
+	oldJournalFile := j.journalFile
+	oldJournalPath := j.journalPath(j.snapshotId)
+
+	path := j.journalPath(newSnapshotId)
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return err
+	}
+	j.journalFile = f
+	j.journalSize = 0
+	j.snapshotId = newSnapshotId
+
+	oldJournalFile.Close()
+	os.Remove(oldJournalPath)
+	return nil
+}
@@ -3,16 +3,18 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/hex"
 	"errors"
 	"fmt"
-	"os"
-	"path/filepath"
+	"net"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
+
+	"fofou/internal/tsutil"
 )
 
 type Post struct {
@@ -82,9 +84,86 @@ type Store struct {
 	// as part of Topic in topics
 	posts []*Post
 
-	dataFile *os.File
+	journal *journal
+	blobs   *BlobStore
+
+	// 0 means "no limit"
+	rateLimitPerIPPerMinute   int
+	rateLimitPerUserPerMinute int
+
+	// blockedIPs holds exact blocked ipAddrInternal values; blockedCIDRNets
+	// holds the parsed form of blocked CIDR ranges, keyed by their textual
+	// CIDR so a later unblock can remove them by key
+	blockedIPs      map[string]bool
+	blockedCIDRNets map[string]*net.IPNet
+
+	// archiveIndex maps an archived topic's id to the file it lives in;
+	// archiveOrder keeps the order topics were archived in (oldest
+	// archived first); archiveCache holds lazily-loaded archived topics
+	// so repeated reads don't re-parse the file
+	archiveIndex map[int]string
+	archiveOrder []int
+	archiveCache map[int]*Topic
+
+	// lastPostMicros is the CreatedOnMicros of the most recently added
+	// post, used to enforce strictly increasing timestamps even when
+	// time.Now() doesn't advance between two posts (common on systems
+	// with a coarse clock, or just two posts in the same microsecond)
+	lastPostMicros int64
+
+	metrics Metrics
+}
+
+// Metrics lets a caller observe how long Store's public methods take and
+// how often they get cancelled via ctx, without the store depending on
+// any particular metrics backend.
+type Metrics interface {
+	ObserveDuration(method string, d time.Duration)
+	IncCancelled(method string)
 }
 
+// WithMetrics sets the hook that Store's public methods report their
+// duration and cancellation counts through (see observeDuration for the
+// methods that don't). It returns store so it can be chained onto
+// NewStore.
+func (store *Store) WithMetrics(m Metrics) *Store {
+	store.metrics = m
+	return store
+}
+
+// observeDuration is called via defer by the public methods that report
+// metrics, to report how long the call took. SetRateLimits, BlockIp,
+// UnblockIp, Archive and GetArchivedTopic don't call it (nor
+// observeCancelled), so they report nothing.
+func (store *Store) observeDuration(method string, start time.Time) {
+	if store.metrics != nil {
+		store.metrics.ObserveDuration(method, time.Since(start))
+	}
+}
+
+// observeCancelled is called by a reporting method when its own ctx.Err()
+// check finds ctx done, so cancellations can be counted separately from
+// normal completions. A ctx error returned from a deeper call (post
+// validation, a blob write or a journal append) is not counted.
+func (store *Store) observeCancelled(method string) {
+	if store.metrics != nil {
+		store.metrics.IncCancelled(method)
+	}
+}
+
+// ErrDuplicatePost is returned by CreateNewPost / AddPostToTopic when the
+// exact same message body has already been posted in the same topic.
+var ErrDuplicatePost = errors.New("fofou: duplicate post")
+
+// ErrRateLimited is returned by CreateNewPost / AddPostToTopic when the
+// poster's IP or user name has exceeded the configured posting rate, so
+// the HTTP layer can render a 429.
+var ErrRateLimited = errors.New("fofou: rate limited")
+
+// ErrBlocked is returned by CreateNewPost / AddPostToTopic when the
+// poster's IP matches a blocked address or CIDR range.
+var ErrBlocked = errors.New("fofou: ip is blocked")
+
 func (t *Topic) IsDeleted() bool {
 	for _, p := range t.Posts {
 		if !p.IsDeleted {
@@ -94,6 +173,46 @@ func (t *Topic) IsDeleted() bool {
 	return true
 }
 
+// blockState accumulates the B/block records seen while parsing the log,
+// keyed by either an ipAddrInternal (for a plain IP) or a CIDR string
+// (for a range). The bool is the last-seen blocked/unblocked state for
+// that key, so a later unblock record overrides an earlier block one.
+type blockState struct {
+	exact map[string]bool
+	cidr  map[string]bool
+}
+
+func newBlockState() *blockState {
+	return &blockState{
+		exact: make(map[string]bool),
+		cidr:  make(map[string]bool),
+	}
+}
+
+func (bs *blockState) apply(key string, blocked bool) {
+	if strings.Contains(key, "/") {
+		bs.cidr[key] = blocked
+	} else {
+		bs.exact[key] = blocked
+	}
+}
+
+// parseBlock parses the "<ipOrCIDRInternal>|<0|1>" fields of a block
+// record: what follows "B|" in a 'B' line, or "U:" in a legacy malformed
+// 'U' line (the caller strips that prefix).
+func parseBlock(d []byte) (key string, blocked bool) {
+	s := string(d)
+	parts := strings.Split(s, "|")
+	if len(parts) != 2 {
+		panic("len(parts) != 2")
+	}
+	n, err := strconv.Atoi(parts[1])
+	if err != nil {
+		panic("invalid blocked flag")
+	}
+	return parts[0], n != 0
+}
+
 func parseDelUndel(d []byte) (int, int) {
 	s := string(d)
 	parts := strings.Split(s, "|")
@@ -144,9 +263,25 @@ func parseTopic(line []byte) Topic {
 	return t
 }
 
+// parsePost parses a legacy 'P' line, whose third field is a unix
+// seconds timestamp:
+// P1|1|1148874103|K4hYtOI8xYt5dYH25VQ7Qcbk73A|4b0af66e|Krzysztof Kowalczyk
 func parsePost(line []byte, topicIdToTopic map[int]*Topic) Post {
-	// parse:
-	// P1|1|1148874103|K4hYtOI8xYt5dYH25VQ7Qcbk73A|4b0af66e|Krzysztof Kowalczyk
+	return parsePostWithTimestamp(line, topicIdToTopic, func(n int64) time.Time {
+		return time.Unix(n, 0)
+	})
+}
+
+// parsePostMicro parses a 'p' line, the higher-resolution variant of
+// parsePost whose third field is unix microseconds instead of seconds.
+// Only the legacy importer ever needs to read 'p' lines: the binary
+// journal stores CreatedOnMicros directly and never goes through this
+// text format.
+func parsePostMicro(line []byte, topicIdToTopic map[int]*Topic) Post {
+	return parsePostWithTimestamp(line, topicIdToTopic, tsutil.UnixMicroToTime)
+}
+
+func parsePostWithTimestamp(line []byte, topicIdToTopic map[int]*Topic, toTime func(int64) time.Time) Post {
 	s := string(line[1:])
 	parts := strings.Split(s, "|")
 	if len(parts) != 6 {
@@ -154,7 +289,7 @@ func parsePost(line []byte, topicIdToTopic map[int]*Topic) Post {
 	}
 	topicIdStr := parts[0]
 	idStr := parts[1]
-	createdOnSecondsStr := parts[2]
+	createdOnStr := parts[2]
 	msgSha1b64 := parts[3] + "="
 	ipAddrInternal := parts[4]
 	userName := parts[5]
@@ -168,11 +303,11 @@ func parsePost(line []byte, topicIdToTopic map[int]*Topic) Post {
 	if err != nil {
 		panic("idStr not a number")
 	}
-	createdOnSeconds, err := strconv.Atoi(createdOnSecondsStr)
+	createdOnValue, err := strconv.ParseInt(createdOnStr, 10, 64)
 	if err != nil {
-		panic("createdOnSeconds not a number")
+		panic("createdOnStr not a number")
 	}
-	createdOn := time.Unix(int64(createdOnSeconds), 0)
+	createdOn := toTime(createdOnValue)
 	msgSha1, err := base64.StdEncoding.DecodeString(msgSha1b64)
 	if err != nil {
 		panic("msgSha1b64 not valid base64")
@@ -184,7 +319,7 @@ func parsePost(line []byte, topicIdToTopic map[int]*Topic) Post {
 	if !ok {
 		panic("didn't find topic with a given topicId")
 	}
-	realPostId := len(t.Posts)+1
+	realPostId := len(t.Posts) + 1
 	if id != realPostId {
 		fmt.Printf("!Unexpected post id:\n")
 		fmt.Printf("  %s\n", string(line))
@@ -206,7 +341,7 @@ func parsePost(line []byte, topicIdToTopic map[int]*Topic) Post {
 	return post
 }
 
-func parseTopics(d []byte, recentPosts *[]*Post) []Topic {
+func parseTopics(d []byte, recentPosts *[]*Post, blocked *blockState) []Topic {
 	topics := make([]Topic, 0)
 	topicIdToTopic := make(map[int]*Topic)
 	for len(d) > 0 {
@@ -221,7 +356,8 @@ func parseTopics(d []byte, recentPosts *[]*Post) []Topic {
 		d = d[idx+1:]
 		c := line[0]
 		// T - topic
-		// P - post
+		// P - post, timestamp in seconds
+		// p - post, timestamp in microseconds (higher-resolution successor to P)
 		// D - delete post
 		// U - undelete post
 		// B - block/unblock ipaddr
@@ -235,6 +371,11 @@ func parseTopics(d []byte, recentPosts *[]*Post) []Topic {
 			t := post.Topic
 			t.Posts = append(t.Posts, post)
 			*recentPosts = append(*recentPosts, &t.Posts[len(t.Posts)-1])
+		case 'p':
+			post := parsePostMicro(line, topicIdToTopic)
+			t := post.Topic
+			t.Posts = append(t.Posts, post)
+			*recentPosts = append(*recentPosts, &t.Posts[len(t.Posts)-1])
 		case 'D':
 			// D|1234|1
 			post := findPostToDelUndel(line[1:], topicIdToTopic)
@@ -243,6 +384,15 @@ func parseTopics(d []byte, recentPosts *[]*Post) []Topic {
 			}
 			post.IsDeleted = true
 		case 'U':
+			if len(line) > 1 && line[1] == ':' {
+				// a buggy older version of blockIp/unblockIp wrote
+				// malformed "U:<ipOrCIDRInternal>|<0|1>" lines that
+				// collided with this undelete opcode; tolerate them
+				// and fold them into the block state like a 'B' line
+				key, isBlocked := parseBlock(line[2:])
+				blocked.apply(key, isBlocked)
+				continue
+			}
 			// U|1234|1
 			post := findPostToDelUndel(line[1:], topicIdToTopic)
 			if !post.IsDeleted {
@@ -250,8 +400,9 @@ func parseTopics(d []byte, recentPosts *[]*Post) []Topic {
 			}
 			post.IsDeleted = false
 		case 'B':
-			// B|$ipAddr|$isBlocked
-			// TODO: write me
+			// B|$ipOrCIDRInternal|$isBlocked
+			key, isBlocked := parseBlock(bytes.TrimPrefix(line[1:], []byte("|")))
+			blocked.apply(key, isBlocked)
 		default:
 			panic("Unexpected line type")
 		}
@@ -259,14 +410,6 @@ func parseTopics(d []byte, recentPosts *[]*Post) []Topic {
 	return topics
 }
 
-func readExistingData(fileDataPath string, recentPosts *[]*Post) ([]Topic, error) {
-	data, err := ReadFileAll(fileDataPath)
-	if err != nil {
-		return nil, err
-	}
-	return parseTopics(data, recentPosts), nil
-}
-
 func verifyTopics(topics []Topic) {
 	for i, t := range topics {
 		if 0 == len(t.Posts) {
@@ -276,52 +419,118 @@ func verifyTopics(topics []Topic) {
 }
 
 func NewStore(dataDir, forumName string) (*Store, error) {
-	dataFilePath := filepath.Join(dataDir, "forum", forumName+".txt")
 	store := &Store{
 		dataDir:   dataDir,
 		forumName: forumName,
 		posts:     make([]*Post, 0),
+		topics:    make([]Topic, 0),
 	}
+	blocked := newBlockState()
 	var err error
-	if PathExists(dataFilePath) {
-		store.topics, err = readExistingData(dataFilePath, &store.posts)
-		if err != nil {
-			fmt.Printf("readExistingData() failed with %s", err.Error())
-			return nil, err
-		}
-	} else {
-		f, err := os.Create(dataFilePath)
-		if err != nil {
-			fmt.Printf("NewStore(): os.Create(%s) failed with %s", dataFilePath, err.Error())
-			return nil, err
-		}
-		f.Close()
-		store.topics = make([]Topic, 0)
+	store.journal, err = openJournal(context.Background(), dataDir, forumName, &store.topics, &store.posts, blocked)
+	if err != nil {
+		fmt.Printf("NewStore(): openJournal() failed with %s", err.Error())
+		return nil, err
 	}
 
 	verifyTopics(store.topics)
+	store.loadBlockState(blocked)
+	for _, p := range store.posts {
+		if micros := tsutil.TimeToUnixMicro(p.CreatedOn); micros > store.lastPostMicros {
+			store.lastPostMicros = micros
+		}
+	}
 
-	store.dataFile, err = os.OpenFile(dataFilePath, os.O_APPEND|os.O_RDWR, 0666)
+	store.blobs, err = NewBlobStore(dataDir, DefaultMaxSegmentSize)
 	if err != nil {
-		fmt.Printf("NewStore(): os.OpenFile(%s) failed with %s", dataFilePath, err.Error())
+		fmt.Printf("NewStore(): NewBlobStore(%s) failed with %s", dataDir, err.Error())
+		return nil, err
+	}
+	// one-time upgrade: any posts still on disk in the legacy
+	// blobs/xx/yy/<sha1> layout get folded into the segmented store
+	if _, err = MigrateLegacyBlobs(context.Background(), dataDir, store.blobs); err != nil {
+		fmt.Printf("NewStore(): MigrateLegacyBlobs(%s) failed with %s", dataDir, err.Error())
+		return nil, err
+	}
+
+	if err = store.loadArchiveIndex(); err != nil {
+		fmt.Printf("NewStore(): loadArchiveIndex() failed with %s", err.Error())
 		return nil, err
 	}
+	store.dropArchivedFromHotSet()
+
 	return store, nil
 }
 
-func (store *Store) TopicsCount() int {
+// dropArchivedFromHotSet removes any topic (and its posts) from
+// store.topics/store.posts that archiveIndex says was already archived.
+// Archiving only ever updates the archive index and the in-memory hot
+// set, never the journal/snapshot, so a replay always rebuilds
+// store.topics with every topic that was ever posted to, archived or
+// not; without this the archived topic would show up twice -- once from
+// the hot set, once from the archive tier -- and a later Archive() run
+// would append it to archiveOrder a second time.
+func (store *Store) dropArchivedFromHotSet() {
+	if len(store.archiveIndex) == 0 {
+		return
+	}
+	remaining := make([]Topic, 0, len(store.topics))
+	for i := range store.topics {
+		if _, archived := store.archiveIndex[store.topics[i].Id]; archived {
+			continue
+		}
+		remaining = append(remaining, store.topics[i])
+	}
+	store.topics = remaining
+
+	filteredPosts := store.posts[:0]
+	for _, p := range store.posts {
+		if _, archived := store.archiveIndex[p.Topic.Id]; !archived {
+			filteredPosts = append(filteredPosts, p)
+		}
+	}
+	store.posts = filteredPosts
+}
+
+func (store *Store) TopicsCount(ctx context.Context) (int, error) {
+	defer store.observeDuration("TopicsCount", time.Now())
+	if err := ctx.Err(); err != nil {
+		store.observeCancelled("TopicsCount")
+		return 0, err
+	}
 	store.Lock()
 	defer store.Unlock()
-	return len(store.topics)
+	return len(store.topics), nil
+}
+
+// TopicsCountDeprecated is TopicsCount without a context, kept for
+// callers not yet migrated to the ctx-first API.
+func (store *Store) TopicsCountDeprecated() int {
+	n, _ := store.TopicsCount(context.Background())
+	return n
 }
 
-func (store *Store) GetTopics(nMax, from int, withDeleted bool) ([]*Topic, int) {
+// GetTopics returns up to nMax topics starting at from (an opaque cursor
+// returned by the previous call; 0 to start from the newest topic). When
+// includeArchive is true and the hot in-memory set is exhausted before
+// nMax is reached, it continues into the archived topics (most recently
+// archived first), transparently merging the two tiers.
+func (store *Store) GetTopics(ctx context.Context, nMax, from int, withDeleted bool, includeArchive bool) ([]*Topic, int, error) {
+	defer store.observeDuration("GetTopics", time.Now())
+	if err := ctx.Err(); err != nil {
+		store.observeCancelled("GetTopics")
+		return nil, 0, err
+	}
 	res := make([]*Topic, 0, nMax)
 	store.Lock()
 	defer store.Unlock()
 	n := nMax
 	i := from
 	for n > 0 {
+		if err := ctx.Err(); err != nil {
+			store.observeCancelled("GetTopics")
+			return nil, 0, err
+		}
 		idx := len(store.topics) - 1 - i
 		if idx < 0 {
 			break
@@ -332,10 +541,42 @@ func (store *Store) GetTopics(nMax, from int, withDeleted bool) ([]*Topic, int)
 		i += 1
 	}
 
+	if includeArchive {
+		for n > 0 {
+			if err := ctx.Err(); err != nil {
+				store.observeCancelled("GetTopics")
+				return nil, 0, err
+			}
+			archIdx := i - len(store.topics)
+			pos := len(store.archiveOrder) - 1 - archIdx
+			if pos < 0 {
+				break
+			}
+			t, err := store.getArchivedTopicUnlocked(store.archiveOrder[pos])
+			if err != nil {
+				break
+			}
+			res = append(res, t)
+			n -= 1
+			i += 1
+		}
+	}
+
+	total := len(store.topics)
+	if includeArchive {
+		total += len(store.archiveOrder)
+	}
 	newFrom := i
-	if len(store.topics)-1-newFrom <= 0 {
+	if total-1-newFrom <= 0 {
 		newFrom = 0
 	}
+	return res, newFrom, nil
+}
+
+// GetTopicsDeprecated is GetTopics without a context, kept for callers
+// not yet migrated to the ctx-first API.
+func (store *Store) GetTopicsDeprecated(nMax, from int, withDeleted bool, includeArchive bool) ([]*Topic, int) {
+	res, newFrom, _ := store.GetTopics(context.Background(), nMax, from, withDeleted, includeArchive)
 	return res, newFrom
 }
 
@@ -350,21 +591,38 @@ func (store *Store) topicByIdUnlocked(id int) *Topic {
 	return nil
 }
 
-func (store *Store) TopicById(id int) *Topic {
+func (store *Store) TopicById(ctx context.Context, id int) (*Topic, error) {
+	defer store.observeDuration("TopicById", time.Now())
+	if err := ctx.Err(); err != nil {
+		store.observeCancelled("TopicById")
+		return nil, err
+	}
 	store.Lock()
 	defer store.Unlock()
-	return store.topicByIdUnlocked(id)
+	return store.topicByIdUnlocked(id), nil
 }
 
-func blobPath(dir, sha1 string) string {
-	d1 := sha1[:2]
-	d2 := sha1[2:4]
-	return filepath.Join(dir, "blobs", d1, d2, sha1)
+// TopicByIdDeprecated is TopicById without a context, kept for callers
+// not yet migrated to the ctx-first API.
+func (store *Store) TopicByIdDeprecated(id int) *Topic {
+	t, _ := store.TopicById(context.Background(), id)
+	return t
 }
 
-func (store *Store) MessageFilePath(sha1 [20]byte) string {
-	sha1Str := hex.EncodeToString(sha1[:])
-	return blobPath(store.dataDir, sha1Str)
+// GetMessage returns the raw post body previously stored under sha1.
+func (store *Store) GetMessage(ctx context.Context, sha1 [20]byte) ([]byte, error) {
+	defer store.observeDuration("GetMessage", time.Now())
+	if err := ctx.Err(); err != nil {
+		store.observeCancelled("GetMessage")
+		return nil, err
+	}
+	return store.blobs.Get(ctx, sha1)
+}
+
+// GetMessageDeprecated is GetMessage without a context, kept for callers
+// not yet migrated to the ctx-first API.
+func (store *Store) GetMessageDeprecated(sha1 [20]byte) ([]byte, error) {
+	return store.GetMessage(context.Background(), sha1)
 }
 
 func (store *Store) findPost(topicId, postId int) (*Post, error) {
@@ -379,15 +637,12 @@ func (store *Store) findPost(topicId, postId int) (*Post, error) {
 	return &topic.Posts[postId-1], nil
 }
 
-func (store *Store) appendString(str string) error {
-	_, err := store.dataFile.WriteString(str)
-	if err != nil {
-		fmt.Printf("appendString() error: %s\n", err.Error())
+func (store *Store) DeletePost(ctx context.Context, topicId, postId int) error {
+	defer store.observeDuration("DeletePost", time.Now())
+	if err := ctx.Err(); err != nil {
+		store.observeCancelled("DeletePost")
+		return err
 	}
-	return err
-}
-
-func (store *Store) DeletePost(topicId, postId int) error {
 	store.Lock()
 	defer store.Unlock()
 
@@ -398,15 +653,26 @@ func (store *Store) DeletePost(topicId, postId int) error {
 	if post.IsDeleted {
 		return errors.New("post already deleted")
 	}
-	str := fmt.Sprintf("D%d|%d\n", topicId, postId)
-	if err = store.appendString(str); err != nil {
+	rec := DelRec{TopicId: uint64(topicId), PostId: uint64(postId)}
+	if err := store.journal.append(ctx, recTypeDel, rec); err != nil {
 		return err
 	}
 	post.IsDeleted = true
-	return nil
+	return store.journal.maybeRotate(ctx, store.topics, store.blockStateSnapshot())
 }
 
-func (store *Store) UndeletePost(topicId, postId int) error {
+// DeletePostDeprecated is DeletePost without a context, kept for callers
+// not yet migrated to the ctx-first API.
+func (store *Store) DeletePostDeprecated(topicId, postId int) error {
+	return store.DeletePost(context.Background(), topicId, postId)
+}
+
+func (store *Store) UndeletePost(ctx context.Context, topicId, postId int) error {
+	defer store.observeDuration("UndeletePost", time.Now())
+	if err := ctx.Err(); err != nil {
+		store.observeCancelled("UndeletePost")
+		return err
+	}
 	store.Lock()
 	defer store.Unlock()
 
@@ -417,12 +683,18 @@ func (store *Store) UndeletePost(topicId, postId int) error {
 	if !post.IsDeleted {
 		return errors.New("post already not deleted")
 	}
-	str := fmt.Sprintf("U%d|%d\n", topicId, postId)
-	if err = store.appendString(str); err != nil {
+	rec := UndelRec{TopicId: uint64(topicId), PostId: uint64(postId)}
+	if err := store.journal.append(ctx, recTypeUndel, rec); err != nil {
 		return err
 	}
 	post.IsDeleted = false
-	return nil
+	return store.journal.maybeRotate(ctx, store.topics, store.blockStateSnapshot())
+}
+
+// UndeletePostDeprecated is UndeletePost without a context, kept for
+// callers not yet migrated to the ctx-first API.
+func (store *Store) UndeletePostDeprecated(topicId, postId int) error {
+	return store.UndeletePost(context.Background(), topicId, postId)
 }
 
 func ipAddrToInternal(ipAddr string) string {
@@ -460,88 +732,307 @@ func ipAddrInternalToOriginal(s string) string {
 	return s
 }
 
-func remSep(s string) string {
-	return strings.Replace(s, "|", "", -1)
+func (store *Store) writeMessageAsSha1(ctx context.Context, msg []byte, sha1 [20]byte) error {
+	gotSha1, err := store.blobs.Put(ctx, msg)
+	if err != nil {
+		logger.Errorf("Store.writeMessageAsSha1(): failed to store blob with error %s", err.Error())
+		return err
+	}
+	if gotSha1 != sha1 {
+		return errors.New("sha1 mismatch writing message blob")
+	}
+	return nil
 }
 
-func (store *Store) writeMessageAsSha1(msg []byte, sha1 [20]byte) error {
-	path := store.MessageFilePath(sha1)
-	err := WriteBytesToFile(msg, path)
-	if err != nil {
-		logger.Errorf("Store.writeMessageAsSha1(): failed to write %s with error %s", path, err.Error())
+// loadBlockState turns the accumulated block records from parsing into
+// the live lookup structures used by IsBlocked. Only called during
+// NewStore, before the store is shared across goroutines.
+func (store *Store) loadBlockState(blocked *blockState) {
+	store.blockedIPs = make(map[string]bool)
+	for k, v := range blocked.exact {
+		if v {
+			store.blockedIPs[k] = true
+		}
+	}
+	store.blockedCIDRNets = make(map[string]*net.IPNet)
+	for k, v := range blocked.cidr {
+		if !v {
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(k)
+		if err != nil {
+			fmt.Printf("loadBlockState(): net.ParseCIDR(%s) failed with %s\n", k, err.Error())
+			continue
+		}
+		store.blockedCIDRNets[k] = ipnet
+	}
+}
+
+// blockStateSnapshot rebuilds a blockState from the live lookup maps, for
+// handing to journal.maybeRotate when it needs to fold the current state
+// into a fresh snapshot.
+func (store *Store) blockStateSnapshot() *blockState {
+	bs := newBlockState()
+	for k := range store.blockedIPs {
+		bs.exact[k] = true
+	}
+	for k := range store.blockedCIDRNets {
+		bs.cidr[k] = true
+	}
+	return bs
+}
+
+// keyForIpOrCIDR normalizes a block/unblock target to the form we store
+// on disk: CIDR ranges are kept as-is (net.ParseCIDR needs the textual
+// form), plain addresses go through the same hex encoding used for
+// Post.IpAddrInternal.
+func keyForIpOrCIDR(ipOrCIDR string) string {
+	if strings.Contains(ipOrCIDR, "/") {
+		return ipOrCIDR
+	}
+	return ipAddrToInternal(ipOrCIDR)
+}
+
+// setBlocked appends a BlockRec for key and, once it's durable, updates
+// the in-memory block state to match. A CIDR range is parsed up front so
+// a bad one is rejected before anything is written to the journal.
+func (store *Store) setBlocked(ctx context.Context, key string, blocked bool) error {
+	isCIDR := strings.Contains(key, "/")
+	var ipnet *net.IPNet
+	if isCIDR && blocked {
+		var err error
+		_, ipnet, err = net.ParseCIDR(key)
+		if err != nil {
+			return err
+		}
+	}
+
+	rec := BlockRec{IpOrCIDR: key, Blocked: blocked}
+	if err := store.journal.append(ctx, recTypeBlock, rec); err != nil {
+		return err
+	}
+
+	if isCIDR {
+		if !blocked {
+			delete(store.blockedCIDRNets, key)
+		} else {
+			store.blockedCIDRNets[key] = ipnet
+		}
+	} else {
+		if !blocked {
+			delete(store.blockedIPs, key)
+		} else {
+			store.blockedIPs[key] = true
+		}
 	}
-	return err
+	return store.journal.maybeRotate(ctx, store.topics, store.blockStateSnapshot())
 }
 
-func (store *Store) blockIp(ipAddr string) {
-	ipAddrInternal := ipAddrToInternal(ipAddr)
-	s := fmt.Sprintf("U:%s|1", ipAddrInternal)
-	store.appendString(s)
+// isBlockedUnlocked is IsBlocked without acquiring the mutex, for use by
+// callers (like validateNewPost) that already hold it.
+func (store *Store) isBlockedUnlocked(ipAddr string) bool {
+	if store.blockedIPs[ipAddrToInternal(ipAddr)] {
+		return true
+	}
+	ip := net.ParseIP(ipAddr)
+	if ip == nil {
+		return false
+	}
+	for _, ipnet := range store.blockedCIDRNets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsBlocked reports whether ipAddr matches a blocked exact address or a
+// blocked CIDR range.
+func (store *Store) IsBlocked(ctx context.Context, ipAddr string) (bool, error) {
+	defer store.observeDuration("IsBlocked", time.Now())
+	if err := ctx.Err(); err != nil {
+		store.observeCancelled("IsBlocked")
+		return false, err
+	}
+	store.Lock()
+	defer store.Unlock()
+	return store.isBlockedUnlocked(ipAddr), nil
 }
 
-func (store *Store) unblockIp(ipAddr string) {
-	ipAddrInternal := ipAddrToInternal(ipAddr)
-	s := fmt.Sprintf("U:%s|0", ipAddrInternal)
-	store.appendString(s)
+// IsBlockedDeprecated is IsBlocked without a context, kept for callers
+// not yet migrated to the ctx-first API.
+func (store *Store) IsBlockedDeprecated(ipAddr string) bool {
+	blocked, _ := store.IsBlocked(context.Background(), ipAddr)
+	return blocked
 }
 
-func (store *Store) addNewPost(msg, user, ipAddr string, topic *Topic, newTopic bool) error {
+func (store *Store) addNewPost(ctx context.Context, msg, user, ipAddr string, topic *Topic, newTopic bool) error {
 	msgBytes := []byte(msg)
 	sha1 := Sha1OfBytes(msgBytes)
+
+	// enforce strictly increasing CreatedOnMicros across all posts, even
+	// if time.Now() didn't advance since the previous one, so CreatedOn
+	// order always agrees with the append order of store.posts, which is
+	// the order GetRecentPosts returns posts in (newest first)
+	micros := tsutil.TimeToUnixMicro(time.Now())
+	if micros <= store.lastPostMicros {
+		micros = store.lastPostMicros + 1
+	}
+
 	p := &Post{
 		Id:               len(topic.Posts) + 1,
-		CreatedOn:        time.Now(),
-		UserNameInternal: remSep(user),
-		IpAddrInternal:   remSep(ipAddrToInternal(ipAddr)),
+		CreatedOn:        tsutil.UnixMicroToTime(micros),
+		UserNameInternal: user,
+		IpAddrInternal:   ipAddrToInternal(ipAddr),
 		IsDeleted:        false,
 		Topic:            topic,
 	}
 	copy(p.MessageSha1[:], sha1)
-	if err := store.writeMessageAsSha1(msgBytes, p.MessageSha1); err != nil {
+	if err := store.writeMessageAsSha1(ctx, msgBytes, p.MessageSha1); err != nil {
 		return err
 	}
 
-	topicStr := ""
+	// persist before touching any in-memory state, so a failed append
+	// (or one whose fsync is abandoned when ctx expires) never leaves a
+	// post/topic visible in memory that didn't actually make it to disk
 	if newTopic {
-		topicStr = fmt.Sprintf("T%d|%s\n", topic.Id, topic.Subject)
+		topicRec := TopicRec{Id: uint64(topic.Id), Subject: topic.Subject}
+		if err := store.journal.append(ctx, recTypeTopic, topicRec); err != nil {
+			return err
+		}
 	}
-
-	s1 := fmt.Sprintf("%d", p.CreatedOn.Unix())
-	s2 := base64.StdEncoding.EncodeToString(p.MessageSha1[:])
-	s2 = s2[:len(s2)-1] // remove unnecessary '=' from the end
-	s3 := p.UserNameInternal
-	sIp := p.IpAddrInternal
-	postStr := fmt.Sprintf("P%d|%d|%s|%s|%s|%s\n", topic.Id, p.Id, s1, s2, sIp, s3)
-	str := topicStr + postStr
-	if err := store.appendString(str); err != nil {
+	postRec := PostRec{
+		TopicId:          uint64(topic.Id),
+		PostId:           uint64(p.Id),
+		CreatedOnMicros:  uint64(tsutil.TimeToUnixMicro(p.CreatedOn)),
+		MessageSha1:      p.MessageSha1,
+		IpAddrInternal:   p.IpAddrInternal,
+		UserNameInternal: p.UserNameInternal,
+	}
+	if err := store.journal.append(ctx, recTypePost, postRec); err != nil {
 		return err
 	}
+
+	store.lastPostMicros = micros
 	topic.Posts = append(topic.Posts, *p)
 	if newTopic {
 		store.topics = append(store.topics, *topic)
 	}
 	store.posts = append(store.posts, &topic.Posts[len(topic.Posts)-1])
+
+	return store.journal.maybeRotate(ctx, store.topics, store.blockStateSnapshot())
+}
+
+// SetRateLimits configures the sliding-window posting limits enforced by
+// CreateNewPost / AddPostToTopic. A value of 0 disables that particular
+// limit. Both windows are one minute wide.
+func (store *Store) SetRateLimits(ctx context.Context, perIPPerMinute, perUserPerMinute int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	store.Lock()
+	defer store.Unlock()
+	store.rateLimitPerIPPerMinute = perIPPerMinute
+	store.rateLimitPerUserPerMinute = perUserPerMinute
+	return nil
+}
+
+// SetRateLimitsDeprecated is SetRateLimits without a context, kept for
+// callers not yet migrated to the ctx-first API.
+func (store *Store) SetRateLimitsDeprecated(perIPPerMinute, perUserPerMinute int) {
+	store.SetRateLimits(context.Background(), perIPPerMinute, perUserPerMinute)
+}
+
+// checkRateLimit counts, from the most recent post backwards, how many
+// posts in the last minute came from ipAddrInternal / userNameInternal.
+// store.posts is time-ordered, so we can stop as soon as we walk past the
+// window.
+func (store *Store) checkRateLimit(ctx context.Context, userNameInternal, ipAddrInternal string) error {
+	if store.rateLimitPerIPPerMinute <= 0 && store.rateLimitPerUserPerMinute <= 0 {
+		return nil
+	}
+	cutoff := time.Now().Add(-time.Minute)
+	nIP, nUser := 0, 0
+	for i := len(store.posts) - 1; i >= 0; i-- {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		p := store.posts[i]
+		if p.CreatedOn.Before(cutoff) {
+			break
+		}
+		if p.IpAddrInternal == ipAddrInternal {
+			nIP++
+		}
+		if p.UserNameInternal == userNameInternal {
+			nUser++
+		}
+	}
+	if store.rateLimitPerIPPerMinute > 0 && nIP >= store.rateLimitPerIPPerMinute {
+		return ErrRateLimited
+	}
+	if store.rateLimitPerUserPerMinute > 0 && nUser >= store.rateLimitPerUserPerMinute {
+		return ErrRateLimited
+	}
 	return nil
 }
 
-func (store *Store) CreateNewPost(subject, msg, user, ipAddr string) (int, error) {
+// validateNewPost rejects a would-be post that repeats an existing post
+// in the same topic, or that would put its IP/user over the configured
+// rate limit. Must be called with store already locked.
+func (store *Store) validateNewPost(ctx context.Context, topic *Topic, msg, user, ipAddr string) error {
+	if store.isBlockedUnlocked(ipAddr) {
+		return ErrBlocked
+	}
+	sha1 := Sha1OfBytes([]byte(msg))
+	for _, p := range topic.Posts {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !p.IsDeleted && bytes.Equal(p.MessageSha1[:], sha1) {
+			return ErrDuplicatePost
+		}
+	}
+	return store.checkRateLimit(ctx, user, ipAddrToInternal(ipAddr))
+}
+
+func (store *Store) CreateNewPost(ctx context.Context, subject, msg, user, ipAddr string) (int, error) {
+	defer store.observeDuration("CreateNewPost", time.Now())
+	if err := ctx.Err(); err != nil {
+		store.observeCancelled("CreateNewPost")
+		return 0, err
+	}
 	store.Lock()
 	defer store.Unlock()
 
 	topic := &Topic{
 		Id:      1,
-		Subject: remSep(subject),
+		Subject: subject,
 		Posts:   make([]Post, 0),
 	}
 	if len(store.topics) > 0 {
 		// Id of the last topic + 1
 		topic.Id = store.topics[len(store.topics)-1].Id + 1
 	}
-	err := store.addNewPost(msg, user, ipAddr, topic, true)
+	if err := store.validateNewPost(ctx, topic, msg, user, ipAddr); err != nil {
+		return 0, err
+	}
+	err := store.addNewPost(ctx, msg, user, ipAddr, topic, true)
 	return topic.Id, err
 }
 
-func (store *Store) AddPostToTopic(topicId int, msg, user, ipAddr string) error {
+// CreateNewPostDeprecated is CreateNewPost without a context, kept for
+// callers not yet migrated to the ctx-first API.
+func (store *Store) CreateNewPostDeprecated(subject, msg, user, ipAddr string) (int, error) {
+	return store.CreateNewPost(context.Background(), subject, msg, user, ipAddr)
+}
+
+func (store *Store) AddPostToTopic(ctx context.Context, topicId int, msg, user, ipAddr string) error {
+	defer store.observeDuration("AddPostToTopic", time.Now())
+	if err := ctx.Err(); err != nil {
+		store.observeCancelled("AddPostToTopic")
+		return err
+	}
 	store.Lock()
 	defer store.Unlock()
 
@@ -549,23 +1040,57 @@ func (store *Store) AddPostToTopic(topicId int, msg, user, ipAddr string) error
 	if topic == nil {
 		return errors.New("invalid topicId")
 	}
-	return store.addNewPost(msg, user, ipAddr, topic, false)
+	if err := store.validateNewPost(ctx, topic, msg, user, ipAddr); err != nil {
+		return err
+	}
+	return store.addNewPost(ctx, msg, user, ipAddr, topic, false)
 }
 
+// AddPostToTopicDeprecated is AddPostToTopic without a context, kept for
+// callers not yet migrated to the ctx-first API.
+func (store *Store) AddPostToTopicDeprecated(topicId int, msg, user, ipAddr string) error {
+	return store.AddPostToTopic(context.Background(), topicId, msg, user, ipAddr)
+}
 
-func (store *Store) BlockIp(ipAddr string) {
+// BlockIp blocks an exact IP address or a CIDR range (e.g. "1.2.3.4" or
+// "1.2.3.0/24") from posting.
+func (store *Store) BlockIp(ctx context.Context, ipOrCIDR string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	store.Lock()
 	defer store.Unlock()
-	store.blockIp(ipAddr)
+	return store.setBlocked(ctx, keyForIpOrCIDR(ipOrCIDR), true)
 }
 
-func (store *Store) UnblockIp(ipAddr string) {
+// BlockIpDeprecated is BlockIp without a context, kept for callers not
+// yet migrated to the ctx-first API.
+func (store *Store) BlockIpDeprecated(ipOrCIDR string) error {
+	return store.BlockIp(context.Background(), ipOrCIDR)
+}
+
+// UnblockIp reverses a previous BlockIp.
+func (store *Store) UnblockIp(ctx context.Context, ipOrCIDR string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	store.Lock()
-	defer store.Unlock()	
-	store.unblockIp(ipAddr)
+	defer store.Unlock()
+	return store.setBlocked(ctx, keyForIpOrCIDR(ipOrCIDR), false)
+}
+
+// UnblockIpDeprecated is UnblockIp without a context, kept for callers
+// not yet migrated to the ctx-first API.
+func (store *Store) UnblockIpDeprecated(ipOrCIDR string) error {
+	return store.UnblockIp(context.Background(), ipOrCIDR)
 }
 
-func (store *Store) GetRecentPosts(max int) []*Post {
+func (store *Store) GetRecentPosts(ctx context.Context, max int) ([]*Post, error) {
+	defer store.observeDuration("GetRecentPosts", time.Now())
+	if err := ctx.Err(); err != nil {
+		store.observeCancelled("GetRecentPosts")
+		return nil, err
+	}
 	store.Lock()
 	defer store.Unlock()
 
@@ -576,17 +1101,37 @@ func (store *Store) GetRecentPosts(max int) []*Post {
 
 	res := make([]*Post, max, max)
 	for i := 0; i < max; i++ {
+		if err := ctx.Err(); err != nil {
+			store.observeCancelled("GetRecentPosts")
+			return nil, err
+		}
 		res[i] = store.posts[len(store.posts)-1-i]
 	}
+	return res, nil
+}
+
+// GetRecentPostsDeprecated is GetRecentPosts without a context, kept for
+// callers not yet migrated to the ctx-first API.
+func (store *Store) GetRecentPostsDeprecated(max int) []*Post {
+	res, _ := store.GetRecentPosts(context.Background(), max)
 	return res
 }
 
-func (store *Store) GetPostsByUserInternal(userNameInternal string, max int) []*Post {
+func (store *Store) GetPostsByUserInternal(ctx context.Context, userNameInternal string, max int) ([]*Post, error) {
+	defer store.observeDuration("GetPostsByUserInternal", time.Now())
+	if err := ctx.Err(); err != nil {
+		store.observeCancelled("GetPostsByUserInternal")
+		return nil, err
+	}
 	store.Lock()
 	defer store.Unlock()
 
 	res := make([]*Post, 0)
 	for i := len(store.posts) - 1; i >= 0; i-- {
+		if err := ctx.Err(); err != nil {
+			store.observeCancelled("GetPostsByUserInternal")
+			return nil, err
+		}
 		p := store.posts[i]
 		if p.UserNameInternal == userNameInternal {
 			res = append(res, p)
@@ -595,15 +1140,31 @@ func (store *Store) GetPostsByUserInternal(userNameInternal string, max int) []*
 			}
 		}
 	}
+	return res, nil
+}
+
+// GetPostsByUserInternalDeprecated is GetPostsByUserInternal without a
+// context, kept for callers not yet migrated to the ctx-first API.
+func (store *Store) GetPostsByUserInternalDeprecated(userNameInternal string, max int) []*Post {
+	res, _ := store.GetPostsByUserInternal(context.Background(), userNameInternal, max)
 	return res
 }
 
-func (store *Store) GetPostsByIpInternal(ipAddrInternal string, max int) []*Post {
+func (store *Store) GetPostsByIpInternal(ctx context.Context, ipAddrInternal string, max int) ([]*Post, error) {
+	defer store.observeDuration("GetPostsByIpInternal", time.Now())
+	if err := ctx.Err(); err != nil {
+		store.observeCancelled("GetPostsByIpInternal")
+		return nil, err
+	}
 	store.Lock()
 	defer store.Unlock()
 
 	res := make([]*Post, 0)
 	for i := len(store.posts) - 1; i >= 0; i-- {
+		if err := ctx.Err(); err != nil {
+			store.observeCancelled("GetPostsByIpInternal")
+			return nil, err
+		}
 		p := store.posts[i]
 		if p.IpAddrInternal == ipAddrInternal {
 			res = append(res, p)
@@ -612,5 +1173,12 @@ func (store *Store) GetPostsByIpInternal(ipAddrInternal string, max int) []*Post
 			}
 		}
 	}
+	return res, nil
+}
+
+// GetPostsByIpInternalDeprecated is GetPostsByIpInternal without a
+// context, kept for callers not yet migrated to the ctx-first API.
+func (store *Store) GetPostsByIpInternalDeprecated(ipAddrInternal string, max int) []*Post {
+	res, _ := store.GetPostsByIpInternal(context.Background(), ipAddrInternal, max)
 	return res
 }
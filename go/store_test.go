@@ -0,0 +1,125 @@
+// This code is in Public Domain. Take all the code you want, I'll just write more.
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func newTestStore(t *testing.T) *Store {
+	dir, err := ioutil.TempDir("", "fofou-store-test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir() failed with %s", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	if err = os.MkdirAll(dir+"/forum", 0755); err != nil {
+		t.Fatalf("os.MkdirAll() failed with %s", err)
+	}
+	store, err := NewStore(dir, "test")
+	if err != nil {
+		t.Fatalf("NewStore() failed with %s", err)
+	}
+	return store
+}
+
+func TestDuplicatePostWithinTopic(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+	topicId, err := store.CreateNewPost(ctx, "subject", "hello", "user1", "1.2.3.4")
+	if err != nil {
+		t.Fatalf("CreateNewPost() failed with %s", err)
+	}
+	err = store.AddPostToTopic(ctx, topicId, "hello", "user1", "1.2.3.4")
+	if err != ErrDuplicatePost {
+		t.Fatalf("expected ErrDuplicatePost, got %v", err)
+	}
+}
+
+func TestDuplicatePostAcrossTopicsAllowed(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+	if _, err := store.CreateNewPost(ctx, "subject1", "hello", "user1", "1.2.3.4"); err != nil {
+		t.Fatalf("CreateNewPost() failed with %s", err)
+	}
+	if _, err := store.CreateNewPost(ctx, "subject2", "hello", "user1", "1.2.3.4"); err != nil {
+		t.Fatalf("expected no error for repost in a different topic, got %s", err)
+	}
+}
+
+func TestRateLimitPerIP(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+	store.SetRateLimits(ctx, 2, 0)
+
+	topicId, err := store.CreateNewPost(ctx, "subject", "msg1", "user1", "1.2.3.4")
+	if err != nil {
+		t.Fatalf("CreateNewPost() failed with %s", err)
+	}
+	if err = store.AddPostToTopic(ctx, topicId, "msg2", "user1", "1.2.3.4"); err != nil {
+		t.Fatalf("AddPostToTopic() failed with %s", err)
+	}
+	err = store.AddPostToTopic(ctx, topicId, "msg3", "user1", "1.2.3.4")
+	if err != ErrRateLimited {
+		t.Fatalf("expected ErrRateLimited, got %v", err)
+	}
+}
+
+func TestRateLimitPerUser(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+	store.SetRateLimits(ctx, 0, 1)
+
+	topicId, err := store.CreateNewPost(ctx, "subject", "msg1", "user1", "1.2.3.4")
+	if err != nil {
+		t.Fatalf("CreateNewPost() failed with %s", err)
+	}
+	// different IP, same user: still rate limited
+	err = store.AddPostToTopic(ctx, topicId, "msg2", "user1", "5.6.7.8")
+	if err != ErrRateLimited {
+		t.Fatalf("expected ErrRateLimited, got %v", err)
+	}
+}
+
+// TestCreateNewPostRespectsCancelledContext verifies that CreateNewPost
+// fails fast with ctx.Err() instead of touching the store when handed an
+// already-cancelled context.
+func TestCreateNewPostRespectsCancelledContext(t *testing.T) {
+	store := newTestStore(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := store.CreateNewPost(ctx, "subject", "hello", "user1", "1.2.3.4")
+	if err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if store.TopicsCountDeprecated() != 0 {
+		t.Fatalf("expected no topic to be created for a cancelled context")
+	}
+}
+
+// TestPostTimestampsAreMonotonic verifies that two posts created back to
+// back never land on the same, or an out-of-order, CreatedOn even when
+// time.Now() doesn't tick forward between them.
+func TestPostTimestampsAreMonotonic(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+
+	topicId, err := store.CreateNewPost(ctx, "subject", "msg1", "user1", "1.2.3.4")
+	if err != nil {
+		t.Fatalf("CreateNewPost() failed with %s", err)
+	}
+	if err = store.AddPostToTopic(ctx, topicId, "msg2", "user2", "5.6.7.8"); err != nil {
+		t.Fatalf("AddPostToTopic() failed with %s", err)
+	}
+
+	topic, err := store.TopicById(ctx, topicId)
+	if err != nil {
+		t.Fatalf("TopicById() failed with %s", err)
+	}
+	if !topic.Posts[1].CreatedOn.After(topic.Posts[0].CreatedOn) {
+		t.Fatalf("expected second post's CreatedOn (%v) to be strictly after the first's (%v)",
+			topic.Posts[1].CreatedOn, topic.Posts[0].CreatedOn)
+	}
+}